@@ -0,0 +1,164 @@
+/*
+This file is part of Cloud Native PostgreSQL.
+
+Copyright (C) 2019-2021 EnterpriseDB Corporation.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// AzureBlobClient wraps the Azure SDK for Go (Track 2) client used to
+// list and count blobs in a container without shelling out to the `az` CLI
+type AzureBlobClient struct {
+	serviceClient *azblob.ServiceClient
+}
+
+// NewAzureBlobClient creates an AzureBlobClient authenticated with a storage
+// account name and key, targeting the given blob endpoint (e.g.
+// "https://<account>.blob.core.windows.net/")
+func NewAzureBlobClient(account, key, endpoint string) (*AzureBlobClient, error) {
+	credential, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceClient, err := azblob.NewServiceClientWithSharedKey(endpoint, credential, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobClient{serviceClient: &serviceClient}, nil
+}
+
+// NewAzuriteBlobClient creates an AzureBlobClient pointed at an Azurite
+// instance, authenticated via a full connection string
+func NewAzuriteBlobClient(connString string) (*AzureBlobClient, error) {
+	serviceClient, err := azblob.NewServiceClientFromConnectionString(connString, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobClient{serviceClient: &serviceClient}, nil
+}
+
+// CountBlobsByPrefix lists the blobs in containerName whose name starts with
+// path, filtering server-side on path as a prefix and paging over the
+// results, and returns how many were found. Blobs that contain path only
+// further into their name are not listed and not counted
+func (c *AzureBlobClient) CountBlobsByPrefix(containerName, path string) (int, error) {
+	containerClient := c.serviceClient.NewContainerClient(containerName)
+	pager := containerClient.NewListBlobsFlatPager(&azblob.ContainerListBlobsFlatOptions{
+		Prefix: &path,
+	})
+
+	count := 0
+	ctx := context.Background()
+	for pager.NextPage(ctx) {
+		for _, blob := range pager.PageResponse().Segment.BlobItems {
+			if blob.Name != nil && strings.Contains(*blob.Name, path) {
+				count++
+			}
+		}
+	}
+
+	if err := pager.Err(); err != nil {
+		return -1, err
+	}
+
+	return count, nil
+}
+
+// ComposeAzBlobListCmd builds the Azure storage blob list command
+//
+// Deprecated: kept only for backward compatibility with callers that still
+// shell out to the `az` CLI. New code should use NewAzureBlobClient instead.
+func ComposeAzBlobListCmd(azStorageAccount, azStorageKey, clusterName string, path string) string {
+	return fmt.Sprintf("az storage blob list --account-name %v  "+
+		"--account-key %v  "+
+		"--container-name %v --query \"[?contains(@.name, \\`%v\\`)].name\"",
+		ShellQuote(azStorageAccount), ShellQuote(azStorageKey), ShellQuote(clusterName), ShellQuote(path))
+}
+
+// ComposeAzBlobListAzuriteCmd builds the Azure storage blob list command for Azurite
+//
+// Deprecated: kept only for backward compatibility with callers that still
+// shell out to the `az` CLI. New code should use NewAzuriteBlobClient instead.
+func ComposeAzBlobListAzuriteCmd(clusterName string, path string) string {
+	return fmt.Sprintf("az storage blob list --container-name %v --query \"[?contains(@.name, \\`%v\\`)].name\" "+
+		"--connection-string $AZURE_CONNECTION_STRING",
+		ShellQuote(clusterName), ShellQuote(path))
+}
+
+// CountFilesOnAzureBlobStorage counts files on Azure Blob storage
+func CountFilesOnAzureBlobStorage(
+	azStorageAccount string,
+	azStorageKey string,
+	clusterName string,
+	path string) (int, error) {
+	endpoint := fmt.Sprintf("https://%v.blob.core.windows.net/", azStorageAccount)
+	client, err := NewAzureBlobClient(azStorageAccount, azStorageKey, endpoint)
+	if err != nil {
+		return -1, err
+	}
+
+	return client.CountBlobsByPrefix(clusterName, path)
+}
+
+// CountFilesOnAzuriteBlobStorage counts files on Azure Blob storage, using Azurite. The test driver runs outside
+// the cluster, so it reaches the in-cluster Azurite service in namespace through a kubectl port-forward tunnel
+// rather than relying on the bare in-cluster service hostname
+func CountFilesOnAzuriteBlobStorage(
+	namespace,
+	clusterName string,
+	path string) (int, error) {
+	stopPortForward, localPort, err := portForward(namespace, "service/azurite", 10000)
+	if err != nil {
+		return -1, err
+	}
+	defer stopPortForward()
+
+	connString := fmt.Sprintf("DefaultEndpointsProtocol=http;AccountName=storageaccountname;"+
+		"AccountKey=storageaccountkey;BlobEndpoint=http://localhost:%d/storageaccountname;", localPort)
+	client, err := NewAzuriteBlobClient(connString)
+	if err != nil {
+		return -1, err
+	}
+
+	return client.CountBlobsByPrefix(clusterName, path)
+}
+
+// portForward starts `kubectl port-forward` from an ephemeral local port to remotePort on target in namespace,
+// returning the chosen local port and a function the caller must invoke to tear the tunnel down
+func portForward(namespace, target string, remotePort int) (func(), int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, 0, err
+	}
+	localPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cmd := exec.Command("kubectl", "port-forward", "-n", namespace, target,
+		fmt.Sprintf("%d:%d", localPort, remotePort))
+	if err := cmd.Start(); err != nil {
+		return nil, 0, err
+	}
+
+	// give kubectl a moment to establish the tunnel before the caller dials it
+	time.Sleep(2 * time.Second)
+
+	stop := func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+	return stop, localPort, nil
+}
@@ -7,9 +7,9 @@ Copyright (C) 2019-2021 EnterpriseDB Corporation.
 package utils
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -19,6 +19,33 @@ import (
 	. "github.com/onsi/gomega" // nolint
 )
 
+// BackupOptions tunes the behaviour of ExecuteBackupWithOptions
+type BackupOptions struct {
+	// Timeout bounds how long to wait for the backup to reach ExpectedPhase
+	Timeout time.Duration
+	// PollInterval is how often the backup status is polled while waiting for ExpectedPhase
+	PollInterval time.Duration
+	// Method, when set, overrides the backup method (e.g. volume snapshot vs. barman object store) requested
+	// in the Backup spec before waiting for it to complete
+	Method apiv1.BackupMethod
+	// ExpectedPhase is the phase to wait for. Defaults to BackupPhaseCompleted
+	ExpectedPhase apiv1.BackupPhase
+	// OnlineOnly skips the default BeginLSN/WAL assertions, which only make sense for a completed backup
+	OnlineOnly bool
+	// VerifyFunc, if set, replaces the default BeginLSN/WAL assertions and is called once ExpectedPhase is reached
+	VerifyFunc func(*apiv1.Backup) error
+}
+
+// DefaultBackupOptions returns the BackupOptions used by ExecuteBackup: the historical 180-second timeout,
+// polling once a second, waiting for BackupPhaseCompleted
+func DefaultBackupOptions() BackupOptions {
+	return BackupOptions{
+		Timeout:       180 * time.Second,
+		PollInterval:  time.Second,
+		ExpectedPhase: apiv1.BackupPhaseCompleted,
+	}
+}
+
 // ExecuteBackup performs a backup and check the backup status
 func ExecuteBackup(namespace string, backupFile string, env *TestingEnvironment) {
 	backupName, err := env.GetResourceNameFromYAML(backupFile)
@@ -29,31 +56,89 @@ func ExecuteBackup(namespace string, backupFile string, env *TestingEnvironment)
 		namespace, backupFile))
 	Expect(err).ToNot(HaveOccurred())
 
-	// After a while the Backup should be completed
-	timeout := 180
+	_, err = waitForBackupPhase(namespace, backupName, DefaultBackupOptions(), env)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+// ExecuteBackupWithManagedIdentity performs a backup against a cluster set up with managed identity credentials
+// and checks the backup status; auth is handled by the AKS workload-identity webhook, so this is a plain backup
+func ExecuteBackupWithManagedIdentity(namespace, backupFile string, env *TestingEnvironment) {
+	ExecuteBackup(namespace, backupFile, env)
+}
+
+// ExecuteBackupWithOptions performs a backup and waits for it to reach opts.ExpectedPhase, letting callers request
+// a specific backup Method, tune the Eventually timeout/interval, or substitute a custom VerifyFunc for the
+// default BeginLSN/WAL assertions. This lets individual E2E scenarios (snapshot backups, WAL-only backups,
+// failure-path tests expecting BackupPhaseFailed, ...) avoid hand-rolling their own Eventually block
+func ExecuteBackupWithOptions(
+	namespace, backupFile string,
+	opts BackupOptions,
+	env *TestingEnvironment) (*apiv1.Backup, error) {
+	backupName, err := env.GetResourceNameFromYAML(backupFile)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = Run(fmt.Sprintf("kubectl apply -n %v -f %v", namespace, backupFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return waitForBackupPhase(namespace, backupName, opts, env)
+}
+
+// waitForBackupPhase waits for the named Backup to reach opts.ExpectedPhase and, unless opts.OnlineOnly or
+// opts.VerifyFunc say otherwise, checks that the resulting status carries a full set of WAL/LSN markers
+func waitForBackupPhase(
+	namespace, backupName string,
+	opts BackupOptions,
+	env *TestingEnvironment) (*apiv1.Backup, error) {
 	backupNamespacedName := types.NamespacedName{
 		Namespace: namespace,
 		Name:      backupName,
 	}
 	backup := &apiv1.Backup{}
-	// Verifying backup status
+
+	if opts.ExpectedPhase == "" {
+		opts.ExpectedPhase = apiv1.BackupPhaseCompleted
+	}
+
+	if opts.Method != "" {
+		Eventually(func() error {
+			if err := env.Client.Get(env.Ctx, backupNamespacedName, backup); err != nil {
+				return err
+			}
+			backup.Spec.Method = opts.Method
+			return env.Client.Update(env.Ctx, backup)
+		}, opts.Timeout, opts.PollInterval).Should(Succeed())
+	}
+
 	Eventually(func() (apiv1.BackupPhase, error) {
-		err = env.Client.Get(env.Ctx, backupNamespacedName, backup)
+		err := env.Client.Get(env.Ctx, backupNamespacedName, backup)
 		return backup.Status.Phase, err
-	}, timeout).Should(BeEquivalentTo(apiv1.BackupPhaseCompleted))
+	}, opts.Timeout, opts.PollInterval).Should(BeEquivalentTo(opts.ExpectedPhase))
+
+	if opts.VerifyFunc != nil {
+		return backup, opts.VerifyFunc(backup)
+	}
+
+	if opts.OnlineOnly || opts.ExpectedPhase != apiv1.BackupPhaseCompleted {
+		return backup, nil
+	}
+
 	Eventually(func() (string, error) {
-		err = env.Client.Get(env.Ctx, backupNamespacedName, backup)
-		if err != nil {
+		if err := env.Client.Get(env.Ctx, backupNamespacedName, backup); err != nil {
 			return "", err
 		}
-		backupStatus := backup.GetStatus()
-		return backupStatus.BeginLSN, err
-	}, timeout).ShouldNot(BeEmpty())
+		return backup.GetStatus().BeginLSN, nil
+	}, opts.Timeout, opts.PollInterval).ShouldNot(BeEmpty())
 
 	backupStatus := backup.GetStatus()
 	Expect(backupStatus.BeginWal).NotTo(BeEmpty())
 	Expect(backupStatus.EndLSN).NotTo(BeEmpty())
 	Expect(backupStatus.EndWal).NotTo(BeEmpty())
+
+	return backup, nil
 }
 
 // CreateClusterFromBackupUsingPITR creates a cluster from backup, using the PITR
@@ -185,6 +270,81 @@ func CreateClusterFromExternalClusterBackupWithPITROnAzure(
 	return env.Client.Create(env.Ctx, restoreCluster)
 }
 
+// CreateClusterFromExternalClusterBackupWithPITROnAzureWithManagedIdentity creates a cluster on Azure, starting from
+// an external cluster backup with PITR, authenticating via the AKS workload-identity webhook instead of a storage key
+func CreateClusterFromExternalClusterBackupWithPITROnAzureWithManagedIdentity(
+	namespace,
+	externalClusterName,
+	sourceClusterName,
+	targetTime,
+	managedIdentityClientID,
+	azStorageAccount string,
+	env *TestingEnvironment) error {
+	storageClassName := os.Getenv("E2E_DEFAULT_STORAGE_CLASS")
+	destinationPath := fmt.Sprintf("https://%v.blob.core.windows.net/%v/", azStorageAccount, sourceClusterName)
+
+	restoreCluster := &apiv1.Cluster{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      externalClusterName,
+			Namespace: namespace,
+		},
+		Spec: apiv1.ClusterSpec{
+			Instances: 3,
+
+			StorageConfiguration: apiv1.StorageConfiguration{
+				Size:         "1Gi",
+				StorageClass: &storageClassName,
+			},
+
+			PostgresConfiguration: apiv1.PostgresConfiguration{
+				Parameters: map[string]string{
+					"log_checkpoints":             "on",
+					"log_lock_waits":              "on",
+					"log_min_duration_statement":  "1000",
+					"log_statement":               "ddl",
+					"log_temp_files":              "1024",
+					"log_autovacuum_min_duration": "1s",
+					"log_replication_commands":    "on",
+				},
+			},
+
+			ServiceAccountTemplate: &apiv1.ServiceAccountTemplate{
+				Metadata: apiv1.Metadata{
+					Labels: map[string]string{
+						"azure.workload.identity/use": "true",
+					},
+					Annotations: map[string]string{
+						"azure.workload.identity/client-id": managedIdentityClientID,
+					},
+				},
+			},
+
+			Bootstrap: &apiv1.BootstrapConfiguration{
+				Recovery: &apiv1.BootstrapRecovery{
+					Source: sourceClusterName,
+					RecoveryTarget: &apiv1.RecoveryTarget{
+						TargetTime: targetTime,
+					},
+				},
+			},
+
+			ExternalClusters: []apiv1.ExternalCluster{
+				{
+					Name: sourceClusterName,
+					BarmanObjectStore: &apiv1.BarmanObjectStoreConfiguration{
+						DestinationPath: destinationPath,
+						AzureCredentials: &apiv1.AzureCredentials{
+							InheritFromAzureAD: true,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return env.Client.Create(env.Ctx, restoreCluster)
+}
+
 // CreateClusterFromExternalClusterBackupWithPITROnMinio creates a cluster on Minio, starting from an external cluster
 // backup with PITR
 func CreateClusterFromExternalClusterBackupWithPITROnMinio(
@@ -264,6 +424,81 @@ func CreateClusterFromExternalClusterBackupWithPITROnMinio(
 	return env.Client.Create(env.Ctx, restoreCluster)
 }
 
+// CreateClusterFromExternalClusterBackupWithPITROnGCS creates a cluster on GCS, starting from an external cluster
+// backup with PITR
+func CreateClusterFromExternalClusterBackupWithPITROnGCS(
+	namespace,
+	externalClusterName,
+	sourceClusterName,
+	targetTime,
+	googleCredentialsSecretName,
+	gcsBucket string,
+	useADC bool,
+	env *TestingEnvironment) error {
+	storageClassName := os.Getenv("E2E_DEFAULT_STORAGE_CLASS")
+	destinationPath := fmt.Sprintf("gs://%v/%v/", gcsBucket, sourceClusterName)
+
+	googleCredentials := apiv1.GoogleCredentials{
+		GKEEnvironment: useADC,
+	}
+	if !useADC {
+		googleCredentials.ApplicationCredentials = &apiv1.SecretKeySelector{
+			LocalObjectReference: apiv1.LocalObjectReference{
+				Name: googleCredentialsSecretName,
+			},
+			Key: "serviceAccountKey",
+		}
+	}
+
+	restoreCluster := &apiv1.Cluster{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      externalClusterName,
+			Namespace: namespace,
+		},
+		Spec: apiv1.ClusterSpec{
+			Instances: 3,
+
+			StorageConfiguration: apiv1.StorageConfiguration{
+				Size:         "1Gi",
+				StorageClass: &storageClassName,
+			},
+
+			PostgresConfiguration: apiv1.PostgresConfiguration{
+				Parameters: map[string]string{
+					"log_checkpoints":             "on",
+					"log_lock_waits":              "on",
+					"log_min_duration_statement":  "1000",
+					"log_statement":               "ddl",
+					"log_temp_files":              "1024",
+					"log_autovacuum_min_duration": "1s",
+					"log_replication_commands":    "on",
+				},
+			},
+
+			Bootstrap: &apiv1.BootstrapConfiguration{
+				Recovery: &apiv1.BootstrapRecovery{
+					Source: sourceClusterName,
+					RecoveryTarget: &apiv1.RecoveryTarget{
+						TargetTime: targetTime,
+					},
+				},
+			},
+
+			ExternalClusters: []apiv1.ExternalCluster{
+				{
+					Name: sourceClusterName,
+					BarmanObjectStore: &apiv1.BarmanObjectStoreConfiguration{
+						DestinationPath:   destinationPath,
+						GoogleCredentials: &googleCredentials,
+					},
+				},
+			},
+		},
+	}
+
+	return env.Client.Create(env.Ctx, restoreCluster)
+}
+
 // CreateClusterFromExternalClusterBackupWithPITROnAzurite creates a cluster with Azurite, starting from an external
 // cluster backup with PITR
 func CreateClusterFromExternalClusterBackupWithPITROnAzurite(
@@ -336,50 +571,3 @@ func CreateClusterFromExternalClusterBackupWithPITROnAzurite(
 
 	return env.Client.Create(env.Ctx, restoreCluster)
 }
-
-// ComposeAzBlobListAzuriteCmd builds the Azure storage blob list command for Azurite
-func ComposeAzBlobListAzuriteCmd(clusterName string, path string) string {
-	return fmt.Sprintf("az storage blob list --container-name %v --query \"[?contains(@.name, \\`%v\\`)].name\" "+
-		"--connection-string $AZURE_CONNECTION_STRING",
-		clusterName, path)
-}
-
-// ComposeAzBlobListCmd builds the Azure storage blob list command
-func ComposeAzBlobListCmd(azStorageAccount, azStorageKey, clusterName string, path string) string {
-	return fmt.Sprintf("az storage blob list --account-name %v  "+
-		"--account-key %v  "+
-		"--container-name %v --query \"[?contains(@.name, \\`%v\\`)].name\"",
-		azStorageAccount, azStorageKey, clusterName, path)
-}
-
-// CountFilesOnAzureBlobStorage counts files on Azure Blob storage
-func CountFilesOnAzureBlobStorage(
-	azStorageAccount string,
-	azStorageKey string,
-	clusterName string,
-	path string) (int, error) {
-	azBlobListCmd := ComposeAzBlobListCmd(azStorageAccount, azStorageKey, clusterName, path)
-	out, _, err := RunUnchecked(azBlobListCmd)
-	if err != nil {
-		return -1, err
-	}
-	var arr []string
-	err = json.Unmarshal([]byte(out), &arr)
-	return len(arr), err
-}
-
-// CountFilesOnAzuriteBlobStorage counts files on Azure Blob storage. using Azurite
-func CountFilesOnAzuriteBlobStorage(
-	namespace,
-	clusterName string,
-	path string) (int, error) {
-	azBlobListCmd := ComposeAzBlobListAzuriteCmd(clusterName, path)
-	out, _, err := RunUnchecked(fmt.Sprintf("kubectl exec -n %v az-cli "+
-		"-- /bin/bash -c '%v'", namespace, azBlobListCmd))
-	if err != nil {
-		return -1, err
-	}
-	var arr []string
-	err = json.Unmarshal([]byte(out), &arr)
-	return len(arr), err
-}
@@ -0,0 +1,44 @@
+/*
+This file is part of Cloud Native PostgreSQL.
+
+Copyright (C) 2019-2021 EnterpriseDB Corporation.
+*/
+
+package utils
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// CountFilesOnGCSStorage counts the files in a GCS bucket whose name
+// starts with path (objects that contain path only further into their name
+// are not counted), replacing the previous reliance on shelling out to `gsutil`
+func CountFilesOnGCSStorage(bucket, path string) (int, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+
+	count := 0
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: path})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return -1, err
+		}
+		if strings.Contains(attrs.Name, path) {
+			count++
+		}
+	}
+
+	return count, nil
+}
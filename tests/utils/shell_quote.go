@@ -0,0 +1,34 @@
+/*
+This file is part of Cloud Native PostgreSQL.
+
+Copyright (C) 2019-2021 EnterpriseDB Corporation.
+*/
+
+package utils
+
+import "strings"
+
+// ShellQuote escapes a value for interpolation into the az storage blob list commands built by
+// ComposeAzBlobListCmd/ComposeAzBlobListAzuriteCmd. Those commands embed the path inside a backtick-delimited
+// JMESPath raw-string literal (itself inside a double-quoted --query argument) and the other values as bare
+// words, and the whole command is in turn passed as a single-quoted argument to `/bin/bash -c` by callers such
+// as the historical CountFilesOnAzuriteBlobStorage `kubectl exec ... -- /bin/bash -c '...'` wrapper. ShellQuote
+// therefore has to defeat two different layers:
+//
+//   - backslash and backtick are escaped first, in that order, so the value can't close the JMESPath raw-string
+//     literal early and inject arbitrary JMESPath into --query;
+//   - double quotes are escaped so the value can't close the --query argument early;
+//   - single quotes can't be escaped with a backslash at all once they're inside single quotes (bash treats `\`
+//     as a literal character there), so every `'` is replaced with the standard `'\''` close-quote,
+//     escaped-quote, reopen-quote sequence instead, which keeps the value safely inert inside the outer
+//     single-quoted wrapper.
+//
+// No other character is escaped: `$`, `;`, `|`, `&` and whitespace pass through unchanged, so they are still
+// interpreted by the shell that runs the composed command.
+func ShellQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "`", "\\`")
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, `'`, `'\''`)
+	return s
+}
@@ -0,0 +1,61 @@
+/*
+This file is part of Cloud Native PostgreSQL.
+
+Copyright (C) 2019-2021 EnterpriseDB Corporation.
+*/
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{`foo'bar`, `foo'\''bar`},
+		{`a"b`, `a\"b`},
+		{"back`tick", "back\\`tick"},
+		{`back\slash`, `back\\slash`},
+		{`foo'bar"baz\qux` + "`", `foo'\''bar\"baz\\qux\` + "`"},
+	}
+
+	for _, c := range cases {
+		if got := ShellQuote(c.input); got != c.expected {
+			t.Errorf("ShellQuote(%q) = %q, expected %q", c.input, got, c.expected)
+		}
+	}
+}
+
+// TestShellQuotePreventsInjection round-trips pathological cluster/path names through
+// ComposeAzBlobListAzuriteCmd and actually executes the result the way CountFilesOnAzuriteBlobStorage
+// historically did, as `kubectl exec ... -- /bin/bash -c '<composed command>'`, to confirm the quoting
+// can't terminate the enclosing single-quoted wrapper and run injected commands.
+func TestShellQuotePreventsInjection(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "PWNED")
+
+	payloads := []string{
+		"x'; touch " + marker + "; echo 'y",
+		"x`touch " + marker + "`y",
+		`x\'; touch ` + marker + `; echo \'y`,
+	}
+
+	for _, payload := range payloads {
+		cmd := ComposeAzBlobListAzuriteCmd(payload, "some/path")
+		wrapped := "/bin/bash -c '" + cmd + "'"
+
+		// az/the connection string aren't available in this test, so the composed command is expected
+		// to fail - we only care whether the injected `touch` ever ran.
+		_ = exec.Command("bash", "-c", wrapped).Run()
+
+		if _, err := os.Stat(marker); err == nil {
+			t.Fatalf("shell injection succeeded for payload %q: %s was created", payload, marker)
+		}
+	}
+}